@@ -2,26 +2,55 @@ package main
 
 import (
 	"bufio"
+	"compress/bzip2"
+	"compress/gzip"
+	"container/heap"
+	"encoding/gob"
 	"errors"
+	"flag"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"log"
 	"math"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"text/tabwriter"
 	"time"
 
 	"golang.org/x/sync/syncmap"
 )
 
+//topKShardCount is the number of counter shards topKStorage spreads tokens across to avoid lock contention
+const topKShardCount = 16
+
+//lineBatchSize is how many lines processFile groups together before handing them to a worker
+const lineBatchSize = 1024
+
 //STRUCTS
-type medianStorageArray struct {
-	mutex          sync.RWMutex
-	size           int
-	frequencyArray [4000]int
+
+//p2Marker is the set of five markers the P² algorithm maintains to estimate a single quantile
+type p2Marker struct {
+	p  float64
+	q  [5]float64
+	n  [5]int
+	np [5]float64
+	dn [5]float64
+}
+
+//quantileEstimator tracks one or more quantiles over a stream of values in O(1) memory per quantile, using the P² algorithm
+type quantileEstimator struct {
+	mutex   sync.RWMutex
+	count   int
+	buffer  []float64
+	markers map[float64]*p2Marker
 }
 
 type keyWordStorage struct {
@@ -36,14 +65,155 @@ type stdVarianceCalculator struct {
 }
 
 type lineDuplicateMap struct {
+	mutex    sync.Mutex
 	Lines    syncmap.Map
+	bloom    *bloomFilter
 	numDupes int
 }
 
+//bloomFilter is a small fixed-size Bloom filter, used as an optional bounded-memory alternative to lineDuplicateMap's
+//exact syncmap.Map, which otherwise grows without bound as distinct lines accumulate
+type bloomFilter struct {
+	Bits      []uint64
+	NumHashes int
+}
+
+//workerShard holds the aggregation state exclusively owned by one pipeline worker, merged into the run totals once every batch is drained
+type workerShard struct {
+	lineStdDev  stdVarianceCalculator
+	tokenStdDev stdVarianceCalculator
+	dupLines    map[string]int
+}
+
+type wordCount struct {
+	word  string
+	count uint64
+}
+
+//topKHeap is a bounded min-heap of wordCounts, used to track the K most frequent tokens seen so far
+type topKHeap []wordCount
+
+func (h topKHeap) Len() int           { return len(h) }
+func (h topKHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h topKHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *topKHeap) Push(x interface{}) {
+	*h = append(*h, x.(wordCount))
+}
+func (h *topKHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
+
+type topKShard struct {
+	mutex  sync.Mutex
+	counts map[string]uint64
+}
+
+type topKStorage struct {
+	shards     [topKShardCount]topKShard
+	Dictionary syncmap.Map
+	useDict    bool
+}
+
 type Stopwatch struct {
 	start, stop time.Time
 }
 
+//sourceReader abstracts over plain files, compressed files, and stdin so processFile can treat them uniformly.
+//rawBytes counts bytes consumed from the underlying on-disk file, before any gzip/bzip2 decompression, so progress
+//reporting can compare like with like against the on-disk sizes filepath.Walk discovers; it's nil for stdin, which
+//has no discoverable size.
+type sourceReader struct {
+	reader   io.Reader
+	closer   io.Closer
+	rawBytes *int64
+}
+
+//countingReader wraps an io.Reader, atomically accumulating into total every byte Read returns
+type countingReader struct {
+	r     io.Reader
+	total *int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	if n > 0 {
+		atomic.AddInt64(cr.total, int64(n))
+	}
+	return n, err
+}
+
+//Consumer lets embedders (a terminal UI, a test, another Go program) observe a run without processFile or the main loop
+//knowing anything about how that observation is presented
+type Consumer interface {
+	Progress(fraction float64)
+	ProgressLabel(path string)
+	Infof(format string, args ...interface{})
+	Debugf(format string, args ...interface{})
+}
+
+//noopConsumer discards every event - the default when -progress isn't set
+type noopConsumer struct{}
+
+func (noopConsumer) Progress(fraction float64)                {}
+func (noopConsumer) ProgressLabel(path string)                 {}
+func (noopConsumer) Infof(format string, args ...interface{})  {}
+func (noopConsumer) Debugf(format string, args ...interface{}) {}
+
+//terminalConsumer renders one progress bar plus an ETA, both derived from cumulative bytes read across all inputs vs.
+//total bytes discovered, and prints a line naming each file as it starts; there is no separate bar for each file
+type terminalConsumer struct {
+	mutex     sync.Mutex
+	startTime time.Time
+}
+
+const progressBarWidth = 40
+
+//Progress renders a progress bar for fraction (0 to 1) along with an ETA extrapolated from elapsed time
+func (tc *terminalConsumer) Progress(fraction float64) {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+
+	if fraction > 1 {
+		fraction = 1
+	}
+	filled := int(fraction * progressBarWidth)
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", progressBarWidth-filled)
+	fmt.Printf("\r[%s] %5.1f%% ETA %s", bar, fraction*100, tc.eta(fraction))
+}
+
+//eta extrapolates remaining time from elapsed time and how much of the run is done so far
+func (tc *terminalConsumer) eta(fraction float64) string {
+	if fraction <= 0 {
+		return "unknown"
+	}
+	elapsed := time.Since(tc.startTime)
+	total := time.Duration(float64(elapsed) / fraction)
+	return (total - elapsed).Round(time.Second).String()
+}
+
+//ProgressLabel announces the file currently being processed
+func (tc *terminalConsumer) ProgressLabel(path string) {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	fmt.Printf("\nProcessing %s\n", path)
+}
+
+//Infof prints a user-facing status line
+func (tc *terminalConsumer) Infof(format string, args ...interface{}) {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	fmt.Printf("\n"+format+"\n", args...)
+}
+
+//Debugf prints a diagnostic line, same as Infof for the terminal reporter
+func (tc *terminalConsumer) Debugf(format string, args ...interface{}) {
+	tc.Infof(format, args...)
+}
+
 func check(err error) {
 	if err != nil {
 		fmt.Errorf(err.Error())
@@ -53,73 +223,200 @@ func check(err error) {
 func main() {
 
 	//SETUP
-	waitGroup := sync.WaitGroup{}
-	channelWaitGroup := sync.WaitGroup{}
+	topK := flag.Int("topk", 0, "report the N most frequent tokens")
+	topKDict := flag.String("topk-dict", "", "restrict -topk to tokens found in this dictionary file")
+	percentilesFlag := flag.String("percentiles", "50", "comma-separated percentiles to report for line/token lengths, e.g. 50,90,99")
+	bench := flag.Bool("bench", false, "print a CSV summary of wall time, lines/sec, and bytes/sec for each run")
+	repeat := flag.Int("repeat", 1, "run the full pipeline this many times, useful with -bench to check for performance regressions")
+	progress := flag.Bool("progress", false, "show an overall progress bar with an ETA, and each file's name as it starts, while processing")
+	statePath := flag.String("state", "", "gob file used to persist aggregator state across runs; loaded at startup if present, saved on exit and on SIGINT")
+	bloomBits := flag.Int("bloom-bits", 0, "track duplicate lines with a Bloom filter of this many bits instead of storing every line (0 disables)")
+	flag.Parse()
+
+	percentiles, err := parsePercentiles(*percentilesFlag)
+	check(err)
+
+	if *bench {
+		fmt.Println("run,seconds,lines_per_sec,bytes_per_sec")
+	}
+
+	var consumer Consumer = noopConsumer{}
+	if *progress {
+		consumer = &terminalConsumer{startTime: time.Now()}
+	}
+
+	newAggregators := func() (*stdVarianceCalculator, *stdVarianceCalculator, *quantileEstimator, *quantileEstimator, *keyWordStorage, *lineDuplicateMap) {
+		ks := &keyWordStorage{}
+		ks.InitializeKeywords("keywords.txt")
+		ldm := newLineDuplicateMap(*bloomBits)
+		return &stdVarianceCalculator{}, &stdVarianceCalculator{}, NewQuantileEstimator(percentiles...), NewQuantileEstimator(percentiles...), ks, ldm
+	}
 
-	lineChan := make(chan string)
-	keyWordStorage := keyWordStorage{}
-	tokenMedian := medianStorageArray{}
-	lineMedian := medianStorageArray{}
-	tokenStdDev := stdVarianceCalculator{}
-	lineStdDev := stdVarianceCalculator{}
-	lineDupMap := lineDuplicateMap{}
+	//-state is about accumulating stats across runs, so when it's set the same aggregators persist across every
+	//-repeat iteration; without it each iteration gets its own fresh aggregators, so repeats stay independent and
+	//comparable, matching what -bench/-repeat is for.
+	var lineStdDev, tokenStdDev *stdVarianceCalculator
+	var lineMedian, tokenMedian *quantileEstimator
+	var keyWordStore *keyWordStorage
+	var lineDupMap *lineDuplicateMap
 
-	keyWordStorage.InitializeKeywords("keywords.txt")
+	if *statePath != "" {
+		lineStdDev, tokenStdDev, lineMedian, tokenMedian, keyWordStore, lineDupMap = newAggregators()
+		if err := loadState(*statePath, lineStdDev, tokenStdDev, lineMedian, tokenMedian, keyWordStore, lineDupMap); err != nil && !os.IsNotExist(err) {
+			log.Fatal(err)
+		}
+
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, os.Interrupt)
+		go func() {
+			<-sigChan
+			if err := saveState(*statePath, lineStdDev, tokenStdDev, lineMedian, tokenMedian, keyWordStore, lineDupMap); err != nil {
+				log.Println(err)
+			}
+			os.Exit(1)
+		}()
+	}
+
+	for run := 1; run <= *repeat; run++ {
+		if *statePath == "" {
+			lineStdDev, tokenStdDev, lineMedian, tokenMedian, keyWordStore, lineDupMap = newAggregators()
+		}
+		runPipeline(run, *topK, *topKDict, percentiles, *bench, consumer, lineStdDev, tokenStdDev, lineMedian, tokenMedian, keyWordStore, lineDupMap)
+	}
+
+	if *statePath != "" {
+		if err := saveState(*statePath, lineStdDev, tokenStdDev, lineMedian, tokenMedian, keyWordStore, lineDupMap); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+//runPipeline processes every input file once, folding the results into the given aggregators and writing results.tsv;
+//it optionally prints a -bench CSV line for the run
+func runPipeline(run int, topK int, topKDict string, percentiles []float64, bench bool, consumer Consumer,
+	lineStdDev, tokenStdDev *stdVarianceCalculator, lineMedian, tokenMedian *quantileEstimator,
+	keyWordStorage *keyWordStorage, lineDupMap *lineDuplicateMap) {
+	start := time.Now()
+
+	lineBatchChan := make(chan []string, runtime.NumCPU())
+	channelWaitGroup := sync.WaitGroup{}
+	workerWaitGroup := sync.WaitGroup{}
+
+	topKStore := topKStorage{}
+	if topKDict != "" {
+		topKStore.InitializeDictionary(topKDict)
+	}
 
 	//PROCESS TEXT FILES
 	searchDir := "text-files/"
 	var fileList []string
+	var discoveredBytes int64
 	err := filepath.Walk(searchDir, func(path string, f os.FileInfo, err error) error {
-		fileList = append(fileList, path)
+		if isProcessableFile(path) {
+			fileList = append(fileList, path)
+			if f != nil {
+				discoveredBytes += f.Size()
+			}
+		}
 		return nil
 	})
 	check(err)
+
+	for _, path := range flag.Args() {
+		fileList = append(fileList, path)
+		if path != "-" {
+			if info, err := os.Stat(path); err == nil {
+				discoveredBytes += info.Size()
+			}
+		}
+	}
+
+	var readBytes int64
 	for _, file := range fileList {
-		if strings.HasSuffix(file, ".txt") {
+		if file == "-" || isProcessableFile(file) {
 			channelWaitGroup.Add(1)
-			go processFile(file, lineChan, &channelWaitGroup)
+			go processFile(file, lineBatchChan, &channelWaitGroup, consumer, &readBytes, discoveredBytes)
 		}
 	}
 	go func() {
 		channelWaitGroup.Wait()
-		close(lineChan)
+		close(lineBatchChan)
 	}()
-	for line := range lineChan {
-		lineLen := len(line)
-		waitGroup.Add(3)
-		go lineDupMap.CheckForDuplicate(line, &waitGroup)
-		go lineStdDev.AddValue(lineLen, &waitGroup)
-		go lineMedian.AddToMedian(lineLen, &waitGroup)
-
-		for _, token := range strings.Fields(line) {
-			tokenLen := len(token)
-			waitGroup.Add(3)
-			go tokenStdDev.AddValue(tokenLen, &waitGroup)
-			go tokenMedian.AddToMedian(tokenLen, &waitGroup)
-			go keyWordStorage.CheckForKeywords(token, &waitGroup)
-		}
+
+	//FIXED WORKER POOL - each worker owns its shard exclusively, so no per-line/per-token goroutine is launched and the
+	//shard's stats need no lock; the shared quantile estimators still take their mutex per value, and top-K counting takes
+	//a shard mutex per token
+	numWorkers := runtime.NumCPU()
+	shards := make([]*workerShard, numWorkers)
+	var totalLines, totalBytes int64
+
+	for i := 0; i < numWorkers; i++ {
+		shards[i] = &workerShard{dupLines: make(map[string]int)}
+		workerWaitGroup.Add(1)
+		go func(shard *workerShard) {
+			defer workerWaitGroup.Done()
+			for batch := range lineBatchChan {
+				for _, line := range batch {
+					lineLen := len(line)
+					atomic.AddInt64(&totalLines, 1)
+					atomic.AddInt64(&totalBytes, int64(lineLen+1))
+
+					shard.lineStdDev.add(lineLen)
+					lineMedian.AddValue(lineLen)
+					shard.dupLines[line]++
+
+					for _, token := range strings.Fields(line) {
+						tokenLen := len(token)
+						shard.tokenStdDev.add(tokenLen)
+						tokenMedian.AddValue(tokenLen)
+						keyWordStorage.CheckForKeywords(token)
+
+						if topK > 0 {
+							topKStore.AddToken(token)
+						}
+					}
+				}
+			}
+		}(shards[i])
 	}
+	workerWaitGroup.Wait()
 
-	waitGroup.Wait()
+	//MERGE SHARDS
+	for _, shard := range shards {
+		lineStdDev.Merge(&shard.lineStdDev)
+		tokenStdDev.Merge(&shard.tokenStdDev)
+		for line, count := range shard.dupLines {
+			for i := 0; i < count; i++ {
+				lineDupMap.CheckLine(line)
+			}
+		}
+	}
 
 	// COLLECT DATA -> WRITE TO RESULTS FILE
 
 	d := lineDupMap.NumDuplicates()
-	lm, err := lineMedian.returnMedian()
-	check(err)
 	ls, err := lineStdDev.returnStdDev()
 	check(err)
-	tm, err := tokenMedian.returnMedian()
-	check(err)
 	ts, err := tokenStdDev.returnStdDev()
 	check(err)
 	keywords := keyWordStorage.ReturnKeywords()
 
 	dString := strconv.Itoa(d)
-	lmString := strconv.FormatFloat(float64(lm), 'f', -1, 64)
 	lsString := strconv.FormatFloat(ls, 'f', -1, 64)
-	tmString := strconv.FormatFloat(float64(tm), 'f', -1, 64)
 	tsString := strconv.FormatFloat(ts, 'f', -1, 64)
+	var linePercentileKeys, linePercentileValues string
+	var tokenPercentileKeys, tokenPercentileValues string
+	for _, p := range percentiles {
+		lp, err := lineMedian.Quantile(p)
+		check(err)
+		tp, err := tokenMedian.Quantile(p)
+		check(err)
+		label := strconv.FormatFloat(p*100, 'f', -1, 64)
+		linePercentileKeys += "lp" + label + "\t"
+		linePercentileValues += strconv.FormatFloat(lp, 'f', -1, 64) + "\t"
+		tokenPercentileKeys += "tp" + label + "\t"
+		tokenPercentileValues += strconv.FormatFloat(tp, 'f', -1, 64) + "\t"
+	}
 	var keyWordKeys string
 	for _, key := range keywords {
 		keyWordKeys += key[0] + "\t"
@@ -134,10 +431,26 @@ func main() {
 
 	w := new(tabwriter.Writer)
 	w.Init(resultsFile, 0, 4, 0, '\t', 0)
-	fmt.Fprintln(w, "d\tlm\tls\ttm\tts\t"+keyWordKeys)
-	fmt.Fprintln(w, dString+"\t"+lmString+"\t"+lsString+"\t"+tmString+"\t"+tsString+"\t"+keyWordFrequences)
+	fmt.Fprintln(w, "d\tls\tts\t"+linePercentileKeys+tokenPercentileKeys+keyWordKeys)
+	fmt.Fprintln(w, dString+"\t"+lsString+"\t"+tsString+"\t"+linePercentileValues+tokenPercentileValues+keyWordFrequences)
+
+	if topK > 0 {
+		topKResults := topKStore.TopK(topK)
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "rank\tword\tcount")
+		for i, wc := range topKResults {
+			fmt.Fprintf(w, "%d\t%s\t%d\n", i+1, wc.word, wc.count)
+		}
+	}
+
 	w.Flush()
 	resultsFile.Close()
+
+	if bench {
+		elapsed := time.Since(start)
+		seconds := elapsed.Seconds()
+		fmt.Printf("%d,%f,%f,%f\n", run, seconds, float64(totalLines)/seconds, float64(totalBytes)/seconds)
+	}
 }
 
 //KEYWORD FUNCTIONALITY CODE
@@ -160,8 +473,7 @@ func (ks *keyWordStorage) InitializeKeywords(filename string) {
 }
 
 //CHeckForKeywords is a streaming function that uses a syncmap to check if a word is a keyword O(1)
-func (ks *keyWordStorage) CheckForKeywords(word string, wg *sync.WaitGroup) {
-	defer wg.Done()
+func (ks *keyWordStorage) CheckForKeywords(word string) {
 	word = strings.ToLower(word)
 	val, ok1 := ks.Keywords.Load(word)
 	if ok1 {
@@ -182,10 +494,118 @@ func (ks *keyWordStorage) ReturnKeywords() [][]string {
 	return returnArray
 }
 
-//CheckForDuplicate takes in any given line, and checks if it has been seen before - O(1)
-func (ldm *lineDuplicateMap) CheckForDuplicate(line string, wg *sync.WaitGroup) {
-	defer wg.Done()
-	_, exists := ldm.Lines.LoadOrStore(line, 1)
+//Snapshot captures every keyword's frequency seen so far
+func (ks *keyWordStorage) Snapshot() map[string]int {
+	snap := make(map[string]int)
+	ks.Keywords.Range(func(k, v interface{}) bool {
+		snap[k.(string)] = v.(int)
+		return true
+	})
+	return snap
+}
+
+//Restore sets each keyword in a previously captured snapshot to its captured frequency, overwriting any count already stored for it
+func (ks *keyWordStorage) Restore(snap map[string]int) {
+	for word, count := range snap {
+		ks.Keywords.Store(word, count)
+	}
+}
+
+//TOP-K FUNCTIONALITY CODE
+
+//InitializeDictionary loads a restriction dictionary from a file, the same way InitializeKeywords does
+func (tk *topKStorage) InitializeDictionary(filename string) {
+
+	file, err := os.Open(filename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.ToLower(scanner.Text())
+		tk.Dictionary.Store(line, true)
+	}
+	tk.useDict = true
+}
+
+//AddToken records an occurrence of word in its shard, skipping it if a dictionary is in use and word isn't in it - O(1)
+func (tk *topKStorage) AddToken(word string) {
+	word = strings.ToLower(word)
+
+	if tk.useDict {
+		if _, ok := tk.Dictionary.Load(word); !ok {
+			return
+		}
+	}
+
+	shard := &tk.shards[fnv32a(word)%topKShardCount]
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	if shard.counts == nil {
+		shard.counts = make(map[string]uint64)
+	}
+	shard.counts[word]++
+}
+
+//fnv32a hashes a string with FNV-1a, used to pick which shard a token's counter lives in
+func fnv32a(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+//TopK merges all shards and returns the K most frequent tokens, highest count first - O(N log K) where N is the number of distinct tokens
+func (tk *topKStorage) TopK(k int) []wordCount {
+	merged := make(map[string]uint64)
+	for i := range tk.shards {
+		tk.shards[i].mutex.Lock()
+		for word, count := range tk.shards[i].counts {
+			merged[word] += count
+		}
+		tk.shards[i].mutex.Unlock()
+	}
+
+	h := &topKHeap{}
+	heap.Init(h)
+	for word, count := range merged {
+		heap.Push(h, wordCount{word, count})
+		if h.Len() > k {
+			heap.Pop(h)
+		}
+	}
+
+	result := make([]wordCount, h.Len())
+	for i := len(result) - 1; i >= 0; i-- {
+		result[i] = heap.Pop(h).(wordCount)
+	}
+	return result
+}
+
+//newLineDuplicateMap creates a duplicate-line tracker, using a Bloom filter of bloomBits bits instead of an exact
+//syncmap.Map when bloomBits > 0
+func newLineDuplicateMap(bloomBits int) *lineDuplicateMap {
+	ldm := &lineDuplicateMap{}
+	if bloomBits > 0 {
+		ldm.bloom = newBloomFilter(bloomBits, 4)
+	}
+	return ldm
+}
+
+//CheckLine merges one line observed by a worker shard into the tracker, incrementing numDupes if it's been seen
+//before - O(1). Takes the same mutex as Snapshot/Restore, since a -state run's SIGINT handler can call Snapshot
+//concurrently with the shard-merge step still calling CheckLine.
+func (ldm *lineDuplicateMap) CheckLine(line string) {
+	ldm.mutex.Lock()
+	defer ldm.mutex.Unlock()
+
+	var exists bool
+	if ldm.bloom != nil {
+		exists = ldm.bloom.TestAndAdd(line)
+	} else {
+		_, exists = ldm.Lines.LoadOrStore(line, true)
+	}
 	if exists {
 		ldm.numDupes++
 	}
@@ -196,88 +616,311 @@ func (ldm *lineDuplicateMap) NumDuplicates() int {
 	return ldm.numDupes
 }
 
-//AddToMedian takes any given value and adds it to the Map, so that median can be calculated quickly in the future - O(1)
-func (ms *medianStorageArray) AddToMedian(num int, wg *sync.WaitGroup) error {
-	ms.mutex.Lock()
-	defer ms.mutex.Unlock()
-	defer wg.Done()
+//lineDuplicateMapSnapshot is the gob-serializable state of a lineDuplicateMap - exactly one of Lines or Bloom is set,
+//matching whichever tracking mode the map was constructed with
+type lineDuplicateMapSnapshot struct {
+	NumDupes int
+	Lines    []string
+	Bloom    *bloomFilter
+}
 
-	if num >= 4000 {
-		return errors.New("index too large, line is too long")
+//Snapshot captures the tracker's duplicate count and its underlying exact line set or Bloom filter, whichever is in use
+func (ldm *lineDuplicateMap) Snapshot() lineDuplicateMapSnapshot {
+	ldm.mutex.Lock()
+	defer ldm.mutex.Unlock()
+
+	snap := lineDuplicateMapSnapshot{NumDupes: ldm.numDupes}
+	if ldm.bloom != nil {
+		bloomCopy := *ldm.bloom
+		bloomCopy.Bits = append([]uint64(nil), ldm.bloom.Bits...)
+		snap.Bloom = &bloomCopy
+		return snap
+	}
+
+	ldm.Lines.Range(func(k, v interface{}) bool {
+		snap.Lines = append(snap.Lines, k.(string))
+		return true
+	})
+	return snap
+}
+
+//Restore replaces the tracker's state with a previously captured snapshot. CheckLine always dispatches on whichever
+//storage this instance was constructed with, so a snapshot taken in the other mode (exact vs Bloom) can't be
+//reconciled into it silently - the caller must resume with the same -bloom-bits setting the state file was saved with.
+func (ldm *lineDuplicateMap) Restore(snap lineDuplicateMapSnapshot) error {
+	ldm.mutex.Lock()
+	defer ldm.mutex.Unlock()
+
+	snapIsBloom := snap.Bloom != nil
+	ldmIsBloom := ldm.bloom != nil
+	if snapIsBloom != ldmIsBloom {
+		return fmt.Errorf("state file's duplicate-line tracking mode (bloom=%t) doesn't match -bloom-bits (bloom=%t); resume with the same -bloom-bits setting used to save it", snapIsBloom, ldmIsBloom)
+	}
+
+	ldm.numDupes = snap.NumDupes
+	if snap.Bloom != nil {
+		ldm.bloom = snap.Bloom
+		return nil
+	}
+	for _, line := range snap.Lines {
+		ldm.Lines.Store(line, true)
 	}
-	ms.frequencyArray[num] = ms.frequencyArray[num] + 1
-	ms.size++
 	return nil
 }
 
-//returnMedian returns the median of values seen so far O(N), where N < 4000
-func (ms *medianStorageArray) returnMedian() (float32, error) {
-	start := time.Now()
-	fmt.Printf("Calculating Median took: %v\n", time.Since(start))
+//newBloomFilter creates a Bloom filter backed by bits bits and using numHashes independent hash functions
+func newBloomFilter(bits int, numHashes int) *bloomFilter {
+	return &bloomFilter{Bits: make([]uint64, (bits+63)/64), NumHashes: numHashes}
+}
 
-	ms.mutex.Lock()
-	defer ms.mutex.Unlock()
+//positions derives NumHashes bit positions for s via double hashing (fnv64a as the base hash, fnv64 as the step)
+func (bf *bloomFilter) positions(s string) []uint64 {
+	h1 := fnv.New64a()
+	h1.Write([]byte(s))
+	base := h1.Sum64()
 
-	if ms.size == 0 {
-		return -1, errors.New("Empty List")
+	h2 := fnv.New64()
+	h2.Write([]byte(s))
+	step := h2.Sum64()
+
+	numBits := uint64(len(bf.Bits)) * 64
+	positions := make([]uint64, bf.NumHashes)
+	for i := range positions {
+		positions[i] = (base + uint64(i)*step) % numBits
 	}
+	return positions
+}
 
-	// If even take an average of two buckets
-	even := ((ms.size % 2) == 0)
-	desiredPos := ms.size / 2
-
-	i := 0
-	index := 0
-
-	if even {
-		for i < desiredPos {
-			if i <= desiredPos && i+ms.frequencyArray[index] > desiredPos { // in the current bucket
-				return float32(index), nil
-			} else if i < desiredPos && i+ms.frequencyArray[index] < desiredPos { // not in the current bucket
-				i += ms.frequencyArray[index]
-				index++
-			} else if i < desiredPos && i+ms.frequencyArray[index] == desiredPos {
-				nextIndex, err := nextBucket(index, ms.frequencyArray)
-				if err != nil {
-					return -1, err
-				}
-				return float32(index+nextIndex) / float32(2), nil
-			}
+//Test reports whether s has probably been added before; false positives are possible, false negatives are not
+func (bf *bloomFilter) Test(s string) bool {
+	for _, pos := range bf.positions(s) {
+		if bf.Bits[pos/64]&(1<<(pos%64)) == 0 {
+			return false
 		}
-		return -1.0, nil
+	}
+	return true
+}
 
-	} else {
+//Add marks s as seen
+func (bf *bloomFilter) Add(s string) {
+	for _, pos := range bf.positions(s) {
+		bf.Bits[pos/64] |= 1 << (pos % 64)
+	}
+}
+
+//TestAndAdd tests s and then adds it, returning whether it was (probably) already present - O(NumHashes)
+func (bf *bloomFilter) TestAndAdd(s string) bool {
+	existed := bf.Test(s)
+	bf.Add(s)
+	return existed
+}
+
+//parsePercentiles turns a comma-separated list like "50,90,99" into fractions like [0.5, 0.9, 0.99]
+func parsePercentiles(s string) ([]float64, error) {
+	var percentiles []float64
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		pct, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return nil, err
+		}
+		percentiles = append(percentiles, pct/100)
+	}
+	return percentiles, nil
+}
+
+//NewQuantileEstimator creates an estimator that tracks the given quantiles (e.g. 0.5, 0.9, 0.99) over a stream of values
+func NewQuantileEstimator(percentiles ...float64) *quantileEstimator {
+	qe := &quantileEstimator{markers: make(map[float64]*p2Marker, len(percentiles))}
+	for _, p := range percentiles {
+		qe.markers[p] = &p2Marker{p: p, dn: [5]float64{0, p / 2, p, (1 + p) / 2, 1}}
+	}
+	return qe
+}
 
-		for i < desiredPos {
-			if i <= desiredPos && i+ms.frequencyArray[index] > desiredPos { // in the current bucket
-				return float32(index), nil
-			} else if i < desiredPos && i+ms.frequencyArray[index] <= desiredPos { // not in the current bucket
-				i += ms.frequencyArray[index]
-				index++
+//AddValue folds a new observation into every tracked quantile - O(1) per quantile, with no upper bound on the observed value.
+//Unlike the per-worker shards it isn't sharded itself, since P² markers can't simply be summed across shards; all workers share this one instance.
+func (qe *quantileEstimator) AddValue(x int) {
+	qe.mutex.Lock()
+	defer qe.mutex.Unlock()
+
+	val := float64(x)
+	qe.count++
+
+	if qe.count <= 5 {
+		qe.buffer = append(qe.buffer, val)
+		if qe.count == 5 {
+			sort.Float64s(qe.buffer)
+			var sorted [5]float64
+			copy(sorted[:], qe.buffer)
+			for _, m := range qe.markers {
+				m.initialize(sorted)
 			}
 		}
-		return -1.0, nil
+		return
+	}
+
+	for _, m := range qe.markers {
+		m.addValue(val)
+	}
+}
+
+//Quantile returns the current estimate for quantile p, which must have been passed to NewQuantileEstimator
+func (qe *quantileEstimator) Quantile(p float64) (float64, error) {
+	qe.mutex.RLock()
+	defer qe.mutex.RUnlock()
+
+	m, ok := qe.markers[p]
+	if !ok {
+		return -1, fmt.Errorf("quantile %v was not configured on this estimator", p)
+	}
+	if qe.count < 5 {
+		return -1, errors.New("not enough values to estimate quantile")
+	}
+	return m.q[2], nil
+}
+
+//p2MarkerSnapshot is the gob-serializable state of a p2Marker
+type p2MarkerSnapshot struct {
+	P  float64
+	Q  [5]float64
+	N  [5]int
+	Np [5]float64
+	Dn [5]float64
+}
+
+//quantileSnapshot is the gob-serializable state of a quantileEstimator
+type quantileSnapshot struct {
+	Count   int
+	Buffer  []float64
+	Markers map[float64]p2MarkerSnapshot
+}
+
+//Snapshot captures every tracked quantile's markers along with the initial-observation buffer
+func (qe *quantileEstimator) Snapshot() quantileSnapshot {
+	qe.mutex.RLock()
+	defer qe.mutex.RUnlock()
+
+	markers := make(map[float64]p2MarkerSnapshot, len(qe.markers))
+	for p, m := range qe.markers {
+		markers[p] = p2MarkerSnapshot{P: m.p, Q: m.q, N: m.n, Np: m.np, Dn: m.dn}
+	}
+	return quantileSnapshot{
+		Count:   qe.count,
+		Buffer:  append([]float64(nil), qe.buffer...),
+		Markers: markers,
 	}
 }
 
-//nextBucket abstracts out logic from the returnMedian function, finding the next non-zero bucket to compute avg of two values
-func nextBucket(index int, array [4000]int) (int, error) {
-	index += 1
-	for index < len(array) {
-		if array[index] > 0 {
-			return index, nil
+//Restore replaces the estimator's markers and buffer with a previously captured snapshot. A percentile that's
+//configured on qe but wasn't tracked in the snapshot (e.g. -percentiles grew between runs) keeps its freshly
+//constructed marker, seeded from the snapshot's first-five-samples buffer when one is available, instead of being
+//dropped - otherwise that percentile would report "not configured" forever even with plenty of samples restored.
+func (qe *quantileEstimator) Restore(snap quantileSnapshot) {
+	qe.mutex.Lock()
+	defer qe.mutex.Unlock()
+
+	qe.count = snap.Count
+	qe.buffer = append([]float64(nil), snap.Buffer...)
+
+	var seed [5]float64
+	haveSeed := qe.count >= 5 && len(qe.buffer) == 5
+	if haveSeed {
+		copy(seed[:], qe.buffer)
+	}
+
+	restored := make(map[float64]*p2Marker, len(qe.markers))
+	for p, m := range qe.markers {
+		if sm, ok := snap.Markers[p]; ok {
+			restored[p] = &p2Marker{p: sm.P, q: sm.Q, n: sm.N, np: sm.Np, dn: sm.Dn}
+		} else if haveSeed {
+			seeded := &p2Marker{p: m.p, dn: m.dn}
+			seeded.initialize(seed)
+			restored[p] = seeded
+		} else {
+			restored[p] = m
 		}
-		index++
 	}
-	return -1, errors.New("reached end of array")
+	qe.markers = restored
 }
 
-//AddValue is a O(1) streaming algorithm that adds a value to a running approx of variance
-func (svc *stdVarianceCalculator) AddValue(x int, wg *sync.WaitGroup) {
-	svc.mutex.Lock()
-	defer svc.mutex.Unlock()
-	defer wg.Done()
+//initialize seeds the marker heights and positions from the first five observations, sorted ascending
+func (m *p2Marker) initialize(sorted [5]float64) {
+	m.q = sorted
+	for i := 0; i < 5; i++ {
+		m.n[i] = i + 1
+	}
+	m.np = [5]float64{1, 1 + 2*m.p, 1 + 4*m.p, 3 + 2*m.p, 5}
+}
+
+//addValue is the P² update step: it locates the cell containing x, advances marker positions, and adjusts interior heights
+func (m *p2Marker) addValue(x float64) {
+	switch {
+	case x < m.q[0]:
+		m.q[0] = x
+	case x >= m.q[4]:
+		m.q[4] = x
+	}
+
+	k := 3
+	switch {
+	case x < m.q[1]:
+		k = 0
+	case x < m.q[2]:
+		k = 1
+	case x < m.q[3]:
+		k = 2
+	}
 
+	for i := k + 1; i < 5; i++ {
+		m.n[i]++
+	}
+	for i := 0; i < 5; i++ {
+		m.np[i] += m.dn[i]
+	}
+
+	for i := 1; i <= 3; i++ {
+		d := m.np[i] - float64(m.n[i])
+		if d >= 1 && m.n[i+1]-m.n[i] > 1 {
+			m.adjust(i, 1)
+		} else if d <= -1 && m.n[i-1]-m.n[i] < -1 {
+			m.adjust(i, -1)
+		}
+	}
+}
+
+//adjust moves marker i by the given sign, preferring the parabolic height update and falling back to linear interpolation
+func (m *p2Marker) adjust(i int, sign int) {
+	d := float64(sign)
+	q := m.parabolic(i, d)
+	if m.q[i-1] < q && q < m.q[i+1] {
+		m.q[i] = q
+	} else {
+		m.q[i] = m.linear(i, sign)
+	}
+	m.n[i] += sign
+}
+
+//parabolic computes the P² parabolic marker-height update for marker i moving by d
+func (m *p2Marker) parabolic(i int, d float64) float64 {
+	n, q := m.n, m.q
+	return q[i] + d/float64(n[i+1]-n[i-1])*
+		((float64(n[i]-n[i-1])+d)*(q[i+1]-q[i])/float64(n[i+1]-n[i])+
+			(float64(n[i+1]-n[i])-d)*(q[i]-q[i-1])/float64(n[i]-n[i-1]))
+}
+
+//linear is the fallback marker-height update used when the parabolic estimate would leave (q[i-1], q[i+1])
+func (m *p2Marker) linear(i int, sign int) float64 {
+	n, q := m.n, m.q
+	return q[i] + float64(sign)*(q[i+sign]-q[i])/float64(n[i+sign]-n[i])
+}
+
+//add folds a single observation into the running mean/variance without locking - callers must own this calculator
+//exclusively, such as a single worker's shard; use Merge to combine shards afterwards
+func (svc *stdVarianceCalculator) add(x int) {
 	svc.iterations += 1
 	delta := float32(x) - svc.runningMean
 	svc.runningMean += (delta / svc.iterations)
@@ -285,6 +928,32 @@ func (svc *stdVarianceCalculator) AddValue(x int, wg *sync.WaitGroup) {
 	svc.runningM2 += delta * delta2
 }
 
+//Merge folds other's running mean/variance into svc using Chan's parallel variance algorithm, so that per-worker
+//shards can be reduced into one total after the pipeline finishes - O(1). Takes the same mutex as Snapshot/Restore,
+//since a -state run's SIGINT handler can call Snapshot concurrently with the shard-merge step still calling Merge.
+func (svc *stdVarianceCalculator) Merge(other *stdVarianceCalculator) {
+	svc.mutex.Lock()
+	defer svc.mutex.Unlock()
+
+	if other.iterations == 0 {
+		return
+	}
+	if svc.iterations == 0 {
+		svc.runningMean = other.runningMean
+		svc.runningM2 = other.runningM2
+		svc.iterations = other.iterations
+		return
+	}
+
+	na, nb := svc.iterations, other.iterations
+	delta := other.runningMean - svc.runningMean
+	total := na + nb
+
+	svc.runningM2 = svc.runningM2 + other.runningM2 + delta*delta*na*nb/total
+	svc.runningMean = (na*svc.runningMean + nb*other.runningMean) / total
+	svc.iterations = total
+}
+
 //returnStdDev is a O(1) algorithm that returns the standard deviation based on a set of numbers seen thus far
 func (svc *stdVarianceCalculator) returnStdDev() (float64, error) {
 	start := time.Now()
@@ -301,25 +970,174 @@ func (svc *stdVarianceCalculator) returnStdDev() (float64, error) {
 	}
 }
 
-//processFile reads through a file, sending its contents to a channel, which is used to process data
-func processFile(filename string, lineChan chan string, channelWaitGroup *sync.WaitGroup) {
-	defer channelWaitGroup.Done()
+//stdVarianceSnapshot is the gob-serializable state of a stdVarianceCalculator
+type stdVarianceSnapshot struct {
+	RunningMean float32
+	RunningM2   float32
+	Iterations  float32
+}
+
+//Snapshot captures the calculator's current running statistics
+func (svc *stdVarianceCalculator) Snapshot() stdVarianceSnapshot {
+	svc.mutex.RLock()
+	defer svc.mutex.RUnlock()
+	return stdVarianceSnapshot{svc.runningMean, svc.runningM2, svc.iterations}
+}
+
+//Restore replaces the calculator's running statistics with a previously captured snapshot
+func (svc *stdVarianceCalculator) Restore(snap stdVarianceSnapshot) {
+	svc.mutex.Lock()
+	defer svc.mutex.Unlock()
+	svc.runningMean = snap.RunningMean
+	svc.runningM2 = snap.RunningM2
+	svc.iterations = snap.Iterations
+}
+
+//newSourceReader opens filename for reading, treating "-" as stdin and transparently decompressing .gz/.bz2 files.
+//Decompression, when any, wraps a countingReader over the raw file so rawBytes tracks on-disk bytes consumed rather
+//than decompressed bytes produced.
+func newSourceReader(filename string) (*sourceReader, error) {
+	if filename == "-" {
+		return &sourceReader{reader: os.Stdin}, nil
+	}
 
 	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	rawBytes := new(int64)
+	counted := &countingReader{r: file, total: rawBytes}
+
+	switch {
+	case strings.HasSuffix(filename, ".gz"):
+		gz, err := gzip.NewReader(counted)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return &sourceReader{reader: gz, closer: file, rawBytes: rawBytes}, nil
+	case strings.HasSuffix(filename, ".bz2"):
+		return &sourceReader{reader: bzip2.NewReader(counted), closer: file, rawBytes: rawBytes}, nil
+	default:
+		return &sourceReader{reader: counted, closer: file, rawBytes: rawBytes}, nil
+	}
+}
+
+//Close closes the underlying file, if any - stdin is left open
+func (sr *sourceReader) Close() error {
+	if sr.closer != nil {
+		return sr.closer.Close()
+	}
+	return nil
+}
+
+//isProcessableFile reports whether path looks like something processFile knows how to read
+func isProcessableFile(path string) bool {
+	return strings.HasSuffix(path, ".txt") || strings.HasSuffix(path, ".gz") || strings.HasSuffix(path, ".bz2")
+}
+
+//processFile reads through a file, grouping its lines into batches of lineBatchSize and sending them to the worker pool.
+//As batches are sent it reports cumulative on-disk bytes read to consumer, against totalBytes discovered up front -
+//for compressed sources that's bytes consumed from the compressed file, not bytes produced by decompression, so it
+//stays comparable to the on-disk sizes filepath.Walk discovered. Stdin has no discoverable size, so progress isn't
+//reported for it.
+func processFile(filename string, batchChan chan []string, channelWaitGroup *sync.WaitGroup, consumer Consumer, readBytes *int64, totalBytes int64) {
+	defer channelWaitGroup.Done()
+
+	consumer.ProgressLabel(filename)
+
+	src, err := newSourceReader(filename)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer file.Close()
+	defer src.Close()
 
-	scanner := bufio.NewScanner(file)
+	scanner := bufio.NewScanner(src.reader)
 	start := time.Now()
+	batch := make([]string, 0, lineBatchSize)
+	var lastRawBytes int64
+	reportProgress := func() {
+		if src.rawBytes == nil {
+			return
+		}
+		rawBytes := atomic.LoadInt64(src.rawBytes)
+		total := atomic.AddInt64(readBytes, rawBytes-lastRawBytes)
+		lastRawBytes = rawBytes
+		if totalBytes > 0 {
+			consumer.Progress(float64(total) / float64(totalBytes))
+		}
+	}
 	for scanner.Scan() {
 		line := scanner.Text()
-		lineChan <- line
+		batch = append(batch, line)
+		if len(batch) == lineBatchSize {
+			batchChan <- batch
+			batch = make([]string, 0, lineBatchSize)
+			reportProgress()
+		}
+	}
+	if len(batch) > 0 {
+		batchChan <- batch
 	}
+	reportProgress()
 	elapsedTime := time.Since(start)
-	fmt.Printf("Reading in "+filename+" took: %v\n", elapsedTime)
+	consumer.Debugf("Reading in %s took: %v", filename, elapsedTime)
 	if err := scanner.Err(); err != nil {
 		log.Fatal(err)
 	}
 }
+
+//pipelineState is the full gob-serializable snapshot persisted via -state, letting a run resume or extend a
+//previous one instead of starting from scratch
+type pipelineState struct {
+	LineStdDev  stdVarianceSnapshot
+	TokenStdDev stdVarianceSnapshot
+	LineMedian  quantileSnapshot
+	TokenMedian quantileSnapshot
+	Keywords    map[string]int
+	DupLines    lineDuplicateMapSnapshot
+}
+
+//loadState decodes a pipelineState from path and restores it into the given aggregators
+func loadState(path string, lineStdDev, tokenStdDev *stdVarianceCalculator, lineMedian, tokenMedian *quantileEstimator,
+	keyWordStorage *keyWordStorage, lineDupMap *lineDuplicateMap) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var state pipelineState
+	if err := gob.NewDecoder(file).Decode(&state); err != nil {
+		return err
+	}
+
+	lineStdDev.Restore(state.LineStdDev)
+	tokenStdDev.Restore(state.TokenStdDev)
+	lineMedian.Restore(state.LineMedian)
+	tokenMedian.Restore(state.TokenMedian)
+	keyWordStorage.Restore(state.Keywords)
+	return lineDupMap.Restore(state.DupLines)
+}
+
+//saveState snapshots the given aggregators and gob-encodes the result to path, overwriting any previous state
+func saveState(path string, lineStdDev, tokenStdDev *stdVarianceCalculator, lineMedian, tokenMedian *quantileEstimator,
+	keyWordStorage *keyWordStorage, lineDupMap *lineDuplicateMap) error {
+	state := pipelineState{
+		LineStdDev:  lineStdDev.Snapshot(),
+		TokenStdDev: tokenStdDev.Snapshot(),
+		LineMedian:  lineMedian.Snapshot(),
+		TokenMedian: tokenMedian.Snapshot(),
+		Keywords:    keyWordStorage.Snapshot(),
+		DupLines:    lineDupMap.Snapshot(),
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return gob.NewEncoder(file).Encode(&state)
+}
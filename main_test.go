@@ -0,0 +1,225 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"testing"
+)
+
+//bruteForcePercentile returns the p-quantile of values via linear interpolation over the sorted slice, used as
+//ground truth to check quantileEstimator's P² approximation against
+func bruteForcePercentile(values []float64, p float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	if len(sorted) == 1 {
+		return sorted[0]
+	}
+	rank := p * float64(len(sorted)-1)
+	lo := int(math.Floor(rank))
+	hi := int(math.Ceil(rank))
+	if lo == hi {
+		return sorted[lo]
+	}
+	frac := rank - float64(lo)
+	return sorted[lo] + (sorted[hi]-sorted[lo])*frac
+}
+
+//TestQuantileEstimatorApproximatesBruteForce feeds a deterministic pseudo-random stream through a quantileEstimator
+//and checks its P² estimate stays close to a brute-force sorted-slice percentile
+func TestQuantileEstimatorApproximatesBruteForce(t *testing.T) {
+	qe := NewQuantileEstimator(0.5, 0.9, 0.99)
+	values := make([]float64, 0, 2000)
+	seed := 1
+	for i := 0; i < 2000; i++ {
+		seed = (seed*1103515245 + 12345) & 0x7fffffff
+		v := float64(seed % 10000)
+		values = append(values, v)
+		qe.AddValue(int(v))
+	}
+
+	const tolerance = 0.05 * 10000
+	for _, p := range []float64{0.5, 0.9, 0.99} {
+		got, err := qe.Quantile(p)
+		if err != nil {
+			t.Fatalf("Quantile(%v): %v", p, err)
+		}
+		want := bruteForcePercentile(values, p)
+		if math.Abs(got-want) > tolerance {
+			t.Errorf("Quantile(%v) = %v, want within %v of brute-force %v", p, got, tolerance, want)
+		}
+	}
+}
+
+//TestQuantileEstimatorSnapshotRestore checks that restoring a snapshot into a fresh estimator reproduces the same
+//quantile estimate the original had
+func TestQuantileEstimatorSnapshotRestore(t *testing.T) {
+	qe := NewQuantileEstimator(0.5)
+	for i := 1; i <= 200; i++ {
+		qe.AddValue(i)
+	}
+	want, err := qe.Quantile(0.5)
+	if err != nil {
+		t.Fatalf("Quantile(0.5) before snapshot: %v", err)
+	}
+
+	restored := NewQuantileEstimator(0.5)
+	restored.Restore(qe.Snapshot())
+
+	got, err := restored.Quantile(0.5)
+	if err != nil {
+		t.Fatalf("Quantile(0.5) after restore: %v", err)
+	}
+	if got != want {
+		t.Errorf("restored estimate = %v, want %v", got, want)
+	}
+}
+
+//TestQuantileEstimatorRestoreKeepsNewlyTrackedPercentile covers resuming with a wider -percentiles list than the
+//state file was saved with: the percentile that wasn't in the snapshot must stay usable instead of reporting
+//"not configured" forever
+func TestQuantileEstimatorRestoreKeepsNewlyTrackedPercentile(t *testing.T) {
+	original := NewQuantileEstimator(0.5)
+	for i := 1; i <= 200; i++ {
+		original.AddValue(i)
+	}
+	snap := original.Snapshot()
+
+	grown := NewQuantileEstimator(0.5, 0.9)
+	grown.Restore(snap)
+
+	if _, err := grown.Quantile(0.5); err != nil {
+		t.Fatalf("Quantile(0.5) after restore: %v", err)
+	}
+	p90, err := grown.Quantile(0.9)
+	if err != nil {
+		t.Fatalf("Quantile(0.9) should stay configured after restore, got error: %v", err)
+	}
+	if p90 < 1 || p90 > 200 {
+		t.Errorf("Quantile(0.9) = %v, want a value seeded from the restored samples (within [1,200])", p90)
+	}
+
+	for i := 201; i <= 400; i++ {
+		grown.AddValue(i)
+	}
+	if _, err := grown.Quantile(0.9); err != nil {
+		t.Fatalf("Quantile(0.9) after further samples: %v", err)
+	}
+}
+
+//TestStdVarianceCalculatorMergeMatchesSinglePass checks that merging two independently-fed shards via Chan's
+//parallel variance algorithm reproduces the stddev a single pass over all the values would have produced
+func TestStdVarianceCalculatorMergeMatchesSinglePass(t *testing.T) {
+	values := []int{4, 8, 15, 16, 23, 42, 7, 9, 3, 50, 12, 19}
+
+	single := &stdVarianceCalculator{}
+	for _, v := range values {
+		single.add(v)
+	}
+	want, err := single.returnStdDev()
+	if err != nil {
+		t.Fatalf("returnStdDev: %v", err)
+	}
+
+	a := &stdVarianceCalculator{}
+	b := &stdVarianceCalculator{}
+	for i, v := range values {
+		if i%2 == 0 {
+			a.add(v)
+		} else {
+			b.add(v)
+		}
+	}
+	merged := &stdVarianceCalculator{}
+	merged.Merge(a)
+	merged.Merge(b)
+
+	got, err := merged.returnStdDev()
+	if err != nil {
+		t.Fatalf("returnStdDev after merge: %v", err)
+	}
+	if math.Abs(got-want) > 1e-4 {
+		t.Errorf("merged stddev = %v, want %v", got, want)
+	}
+}
+
+//TestLineDuplicateMapCountsRepeatsWithinOneShard guards against a worker shard collapsing repeated occurrences of
+//the same line into a single entry before the merge step ever sees them - a line repeated by one worker must still
+//be counted as a duplicate
+func TestLineDuplicateMapCountsRepeatsWithinOneShard(t *testing.T) {
+	shard := map[string]int{}
+	for _, line := range []string{"hello world", "foo bar", "hello world"} {
+		shard[line]++
+	}
+
+	ldm := newLineDuplicateMap(0)
+	for line, count := range shard {
+		for i := 0; i < count; i++ {
+			ldm.CheckLine(line)
+		}
+	}
+
+	if got, want := ldm.NumDuplicates(), 1; got != want {
+		t.Errorf("NumDuplicates() = %d, want %d", got, want)
+	}
+}
+
+//TestLineDuplicateMapSnapshotRestoreExactMode checks that restoring an exact-mode snapshot into a fresh exact-mode
+//tracker reproduces its duplicate count and keeps recognizing previously-seen lines
+func TestLineDuplicateMapSnapshotRestoreExactMode(t *testing.T) {
+	ldm := newLineDuplicateMap(0)
+	for _, line := range []string{"a", "b", "a", "c", "b"} {
+		ldm.CheckLine(line)
+	}
+	snap := ldm.Snapshot()
+
+	restored := newLineDuplicateMap(0)
+	if err := restored.Restore(snap); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if got, want := restored.NumDuplicates(), ldm.NumDuplicates(); got != want {
+		t.Errorf("NumDuplicates() after restore = %d, want %d", got, want)
+	}
+
+	restored.CheckLine("a")
+	if got, want := restored.NumDuplicates(), ldm.NumDuplicates()+1; got != want {
+		t.Errorf("NumDuplicates() after restore+CheckLine = %d, want %d", got, want)
+	}
+}
+
+//TestLineDuplicateMapRestoreRejectsModeMismatch guards against resuming a -state file saved in one duplicate-line
+//tracking mode (exact vs Bloom) into an instance configured with the other: CheckLine always dispatches on the
+//current instance's mode, so a silently-accepted mismatch would make the restored history permanently inert
+func TestLineDuplicateMapRestoreRejectsModeMismatch(t *testing.T) {
+	exact := newLineDuplicateMap(0)
+	exact.CheckLine("a")
+	snap := exact.Snapshot()
+
+	bloom := newLineDuplicateMap(4096)
+	if err := bloom.Restore(snap); err == nil {
+		t.Fatal("Restore across an exact->bloom mode mismatch should error, got nil")
+	}
+}
+
+//TestStdVarianceCalculatorSnapshotRestore is a basic Snapshot/Restore round trip check for stdVarianceCalculator's
+//persisted state (the snapshot is passed directly, without gob encoding), alongside the Merge coverage above
+func TestStdVarianceCalculatorSnapshotRestore(t *testing.T) {
+	svc := &stdVarianceCalculator{}
+	for _, v := range []int{1, 2, 3, 4, 5} {
+		svc.add(v)
+	}
+	want, err := svc.returnStdDev()
+	if err != nil {
+		t.Fatalf("returnStdDev: %v", err)
+	}
+
+	restored := &stdVarianceCalculator{}
+	restored.Restore(svc.Snapshot())
+
+	got, err := restored.returnStdDev()
+	if err != nil {
+		t.Fatalf("returnStdDev after restore: %v", err)
+	}
+	if got != want {
+		t.Errorf("stddev after restore = %v, want %v", got, want)
+	}
+}